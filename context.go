@@ -0,0 +1,75 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"sync"
+)
+
+var ctxM sync.Mutex // Mutex for below
+var mainCtx, mainCancel = context.WithCancel(context.Background())
+var stageCtx = make([]context.Context, StageCount)
+var stageCancel = make([]context.CancelFunc, StageCount)
+
+func init() {
+	for i := range stageCtx {
+		stageCtx[i], stageCancel[i] = context.WithCancel(context.Background())
+	}
+}
+
+// Context returns a context that is cancelled once Shutdown has waited for
+// outstanding locks (see LockTimeout), before any stage notifiers are run.
+func Context() context.Context {
+	ctxM.Lock()
+	defer ctxM.Unlock()
+	return mainCtx
+}
+
+// PreShutdownContext returns a context that is cancelled when the
+// preshutdown stage begins, at the same time PreShutdown and
+// PreShutdownFunc notifiers are sent.
+func PreShutdownContext() context.Context {
+	return stageContext(StagePreShutdown)
+}
+
+// FirstContext returns a context that is cancelled when the first shutdown
+// stage begins, at the same time First and FirstFunc notifiers are sent.
+func FirstContext() context.Context {
+	return stageContext(StageFirst)
+}
+
+// SecondContext returns a context that is cancelled when the second shutdown
+// stage begins, at the same time Second and SecondFunc notifiers are sent.
+func SecondContext() context.Context {
+	return stageContext(StageSecond)
+}
+
+// ThirdContext returns a context that is cancelled when the third shutdown
+// stage begins, at the same time Third and ThirdFunc notifiers are sent.
+func ThirdContext() context.Context {
+	return stageContext(StageThird)
+}
+
+func stageContext(stage int) context.Context {
+	ctxM.Lock()
+	defer ctxM.Unlock()
+	return stageCtx[stage]
+}
+
+// WithContext returns a context derived from parent, that is cancelled as
+// soon as either parent is done or a shutdown is requested. Use this to hand
+// a single context to HTTP servers, database drivers or gRPC calls so they
+// abort cleanly when Shutdown is called.
+func WithContext(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+	done := Context().Done()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx
+}
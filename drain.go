@@ -0,0 +1,130 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Drainable is a subsystem registered with RegisterDrainable. During
+// shutdown, drain is called first so in-flight work can finish while new
+// intake is blocked; stop is only called once drain returns, or once the
+// deadline for the stage it runs in is reached.
+type Drainable struct {
+	name  string
+	drain func(ctx context.Context) error
+	stop  func()
+
+	mu    sync.Mutex
+	after []*Drainable
+}
+
+var drainablesM sync.Mutex // Mutex for below
+var drainables []*Drainable
+
+// RegisterDrainable registers a subsystem to be drained, then stopped,
+// during shutdown. drain should block new intake and wait for in-flight
+// work to finish, respecting ctx's deadline; stop is called once drain
+// returns (or the deadline passes) and should release the subsystem for
+// good.
+//
+// Drainables all run in the same shutdown stage, concurrently by default.
+// Use the returned Drainable's After method to order one after another,
+// e.g. so an HTTP server drains before the database pool it depends on is
+// closed.
+func RegisterDrainable(name string, drain func(ctx context.Context) error, stop func()) *Drainable {
+	d := &Drainable{name: name, drain: drain, stop: stop}
+	drainablesM.Lock()
+	drainables = append(drainables, d)
+	drainablesM.Unlock()
+	return d
+}
+
+// After declares that d must not start draining until other has finished
+// stopping. Dependencies must not form a cycle. Call this before shutdown
+// begins.
+func (d *Drainable) After(other *Drainable) {
+	d.mu.Lock()
+	d.after = append(d.after, other)
+	d.mu.Unlock()
+}
+
+// runDrainables drains and stops all registered drainables, honoring the
+// After dependencies between them, giving up after d once it expires.
+func runDrainables(d time.Duration) {
+	drainablesM.Lock()
+	list := make([]*Drainable, len(drainables))
+	copy(list, drainables)
+	drainablesM.Unlock()
+	if len(list) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	finished := make(map[*Drainable]chan struct{}, len(list))
+	for _, dr := range list {
+		finished[dr] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(list))
+	for _, dr := range list {
+		dr := dr
+		go func() {
+			defer wg.Done()
+			dr.mu.Lock()
+			after := append([]*Drainable(nil), dr.after...)
+			dr.mu.Unlock()
+			for _, dep := range after {
+				if ch, ok := finished[dep]; ok {
+					select {
+					case <-ch:
+					case <-ctx.Done():
+					}
+				}
+			}
+			runDrainable(ctx, dr)
+			close(finished[dr])
+		}()
+	}
+
+	wg.Wait()
+}
+
+// runDrainable calls d.drain and, once it returns, d.stop. If ctx's
+// deadline passes first, d.stop is called right away without waiting any
+// further for d.drain to return, so a drain that doesn't honor ctx can
+// delay shutdown but can't prevent the forced stop.
+func runDrainable(ctx context.Context, d *Drainable) {
+	if d.drain != nil {
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			defer func() {
+				if r := recover(); r != nil {
+					log.Println("panic draining", d.name, ":", r)
+				}
+			}()
+			if err := d.drain(ctx); err != nil {
+				log.Println("error draining", d.name, ":", err)
+			}
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			log.Println("timeout draining", d.name, ", forcing stop")
+		}
+	}
+	if d.stop != nil {
+		d.stop()
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// LockToken identifies a lock acquired with LockWithName, so it can later
+// be released and identified in diagnostics if it is never released.
+type LockToken int64
+
+type lockInfo struct {
+	name     string
+	caller   string
+	acquired time.Time
+}
+
+var lockM sync.Mutex // Mutex for below
+var nextLockToken LockToken
+var activeLocks = make(map[LockToken]lockInfo)
+var anonLockTokens []LockToken // tokens handed out by Lock, awaiting Unlock
+
+var lockWG sync.WaitGroup // Outstanding Lock/LockWithName holders
+
+var lockTimeoutM sync.RWMutex // Mutex for below
+var lockTimeout time.Duration
+
+// Lock indicates you want to make sure nothing gets shut down before you
+// call Unlock. If false is returned, a shutdown is already in progress and
+// you should not proceed, nor call Unlock.
+func Lock() bool {
+	ok, token := lock("")
+	if !ok {
+		return false
+	}
+	lockM.Lock()
+	anonLockTokens = append(anonLockTokens, token)
+	lockM.Unlock()
+	return true
+}
+
+// Unlock will release a lock acquired with Lock. A stray call with no
+// matching Lock is a harmless no-op.
+func Unlock() {
+	lockM.Lock()
+	n := len(anonLockTokens)
+	if n > 0 {
+		token := anonLockTokens[n-1]
+		anonLockTokens = anonLockTokens[:n-1]
+		delete(activeLocks, token)
+	}
+	lockM.Unlock()
+	if n > 0 {
+		lockWG.Done()
+	}
+}
+
+// LockWithName behaves like Lock, but records name together with the
+// caller's file:line and acquisition time. If the shutdown ever gets stuck
+// waiting for locks to be released, this information is logged to help
+// identify which lock holder is blocking it. Call the returned token's
+// Unlock method when done.
+func LockWithName(name string) (bool, LockToken) {
+	return lock(name)
+}
+
+func lock(name string) (bool, LockToken) {
+	if Started() {
+		return false, 0
+	}
+	lockWG.Add(1)
+
+	_, file, line, _ := runtime.Caller(2)
+	lockM.Lock()
+	nextLockToken++
+	token := nextLockToken
+	activeLocks[token] = lockInfo{
+		name:     name,
+		caller:   fmt.Sprintf("%s:%d", file, line),
+		acquired: time.Now(),
+	}
+	lockM.Unlock()
+	return true, token
+}
+
+// Unlock releases a lock acquired with LockWithName.
+func (t LockToken) Unlock() {
+	lockM.Lock()
+	delete(activeLocks, t)
+	lockM.Unlock()
+	lockWG.Done()
+}
+
+// LockTimeout sets how long Shutdown should wait for any outstanding Lock
+// or LockWithName holders to call Unlock before it proceeds to run the
+// stage notifiers regardless. The default, 0, means Shutdown does not wait
+// for locks at all.
+func LockTimeout(d time.Duration) {
+	lockTimeoutM.Lock()
+	lockTimeout = d
+	lockTimeoutM.Unlock()
+}
+
+// waitForLocks waits for all outstanding locks to be released, for up to
+// the duration configured with LockTimeout. If the wait times out, the
+// still-outstanding locks are logged to help diagnose a stuck shutdown.
+func waitForLocks() {
+	lockTimeoutM.RLock()
+	d := lockTimeout
+	lockTimeoutM.RUnlock()
+	if d <= 0 {
+		return
+	}
+	released := make(chan struct{})
+	go func() {
+		lockWG.Wait()
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-time.After(d):
+		logOutstandingLocks()
+	}
+}
+
+func logOutstandingLocks() {
+	lockM.Lock()
+	defer lockM.Unlock()
+	if len(activeLocks) == 0 {
+		return
+	}
+	log.Println("timeout waiting for locks to release, forcing shutdown. Outstanding locks:")
+	for token, info := range activeLocks {
+		name := info.name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		log.Printf("  lock %d %q acquired at %s, held for %s", token, name, info.caller, time.Since(info.acquired))
+	}
+}
@@ -28,19 +28,55 @@ type fnNotify struct {
 	cancel   chan struct{}
 }
 
+// Shutdown stages, in the order they run in.
+const (
+	// StagePreShutdown runs before any other stage. It is meant for
+	// things like flipping a health-check endpoint to "not ready", so
+	// load balancers can drain traffic before the real teardown in
+	// StageFirst/StageSecond/StageThird begins.
+	StagePreShutdown = iota
+	StageFirst
+	StageSecond
+	StageThird
+
+	// StageCount is the number of shutdown stages.
+	StageCount
+)
+
 var sqM sync.Mutex // Mutex for below
-var shutdownQueue [3][]Notifier
-var shutdownFnQueue [3][]fnNotify
+var shutdownQueue = make([][]Notifier, StageCount)
+var shutdownFnQueue = make([][]fnNotify, StageCount)
 
 var srM sync.RWMutex // Mutex for below
 var shutdownRequested = false
-var timeout = 5 * time.Second
+var timeouts = newDefaultTimeouts()
+
+func newDefaultTimeouts() []time.Duration {
+	to := make([]time.Duration, StageCount)
+	for i := range to {
+		to[i] = 5 * time.Second
+	}
+	return to
+}
 
-// The maximum delay to wait for each stage to finish.
+// SetTimeout sets the maximum delay to wait for each stage to finish.
 // When the timeout has expired for a stage the next stage will be initiated.
+// This sets the timeout for all stages; use SetTimeoutN to configure a
+// single stage.
 func SetTimeout(d time.Duration) {
 	srM.Lock()
-	timeout = d
+	for i := range timeouts {
+		timeouts[i] = d
+	}
+	srM.Unlock()
+}
+
+// SetTimeoutN sets the maximum delay to wait for a single stage to finish.
+// When the timeout has expired for that stage the next stage will be
+// initiated.
+func SetTimeoutN(stage int, d time.Duration) {
+	srM.Lock()
+	timeouts[stage] = d
 	srM.Unlock()
 }
 
@@ -59,7 +95,7 @@ func (s *Notifier) Cancel() {
 	var a chan chan struct{}
 	var b chan chan struct{}
 	a = *s
-	for n := 0; n < 3; n++ {
+	for n := 0; n < StageCount; n++ {
 		for i := range shutdownQueue[n] {
 			b = shutdownQueue[n][i]
 			if a == b {
@@ -86,37 +122,49 @@ func (s *Notifier) Cancel() {
 	sqM.Unlock()
 }
 
-// First returns a notifier that will be called in the first stage of shutdowns
-func First() Notifier {
-	return onShutdown(0)
+// PreShutdown returns a notifier that will be called in the preshutdown
+// stage, before any other notifier. This runs first and is meant for
+// things like flipping a health-check endpoint to "not ready".
+func PreShutdown() Notifier {
+	return onShutdown(StagePreShutdown)
 }
 
 type ShutdownFn func(interface{})
 
+// PreShutdownFunc executes a function in the preshutdown stage
+func PreShutdownFunc(fn ShutdownFn, v interface{}) Notifier {
+	return onFunc(StagePreShutdown, fn, v)
+}
+
+// First returns a notifier that will be called in the first stage of shutdowns
+func First() Notifier {
+	return onShutdown(StageFirst)
+}
+
 // FirstFunc executes a function in the first stage of the shutdown
 func FirstFunc(fn ShutdownFn, v interface{}) Notifier {
-	return onFunc(0, fn, v)
+	return onFunc(StageFirst, fn, v)
 }
 
 // Second returns a notifier that will be called in the second stage of shutdowns
 func Second() Notifier {
-	return onShutdown(1)
+	return onShutdown(StageSecond)
 }
 
 // SecondFunc executes a function in the second stage of the shutdown
 func SecondFunc(fn ShutdownFn, v interface{}) Notifier {
-	return onFunc(1, fn, v)
+	return onFunc(StageSecond, fn, v)
 }
 
 // Third returns a notifier that will be called in the third stage of shutdowns
 func Third() Notifier {
-	return onShutdown(2)
+	return onShutdown(StageThird)
 }
 
 // ThirdFunc executes a function in the third stage of the shutdown
 // The returned Notifier is only really useful for cancelling the shutdown function
 func ThirdFunc(fn ShutdownFn, v interface{}) Notifier {
-	return onFunc(2, fn, v)
+	return onFunc(StageThird, fn, v)
 }
 
 // Create a function notifier.
@@ -169,43 +217,82 @@ func onShutdown(prio int) Notifier {
 	return n
 }
 
-// OnSignal will start the shutdown when any of the given signals arrive
+// OnSignal will start the shutdown when any of the given signals arrive.
 //
 // A good shutdown default is
 //    shutdown.OnSignal(0, os.Interrupt, syscall.SIGTERM)
 // which will do shutdown on Ctrl+C and when the program is terminated.
+//
+// OnSignal no longer calls os.Exit itself; instead the triggering signal and
+// exitCode are recorded and can be picked up through Wait, so main can run
+// its own deferred cleanup before choosing when and how to exit. Use Exit
+// if you want the previous call-and-exit behavior.
 func OnSignal(exitCode int, sig ...os.Signal) {
 	// capture signal and shut down.
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, sig...)
 	go func() {
-		for _ = range c {
+		for s := range c {
+			requestShutdown(s, exitCode, true)
 			Shutdown()
-			os.Exit(exitCode)
 		}
 	}()
 }
 
 // Exit performs shutdown operations and exits with the given exit code.
 func Exit(code int) {
-	Shutdown()
+	Shutdown(ExitCode(code))
 	os.Exit(code)
 }
 
-// Shutdown will signal all notifiers in three stages.
-func Shutdown() {
+// shutdownOnce guards the actual stage processing below, so Shutdown can be
+// called any number of times - concurrently, from signals and subsystems
+// alike - and will only run the notifiers once.
+var shutdownOnce sync.Once
+
+// Shutdown will signal all notifiers in the preshutdown, first, second and
+// third stages, in that order.
+//
+// It can be invoked multiple times and from multiple goroutines; only the
+// first call runs the notifiers, but every call that passes ExitCode
+// updates the exit code reported through Wait. A plain Shutdown() with no
+// options leaves a previously set exit code alone.
+func Shutdown(opts ...ShutdownOption) {
+	var o shutdownOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	requestShutdown(nil, o.exitCode, o.exitCodeSet)
+	shutdownOnce.Do(runShutdown)
+}
+
+func runShutdown() {
 	srM.Lock()
 	shutdownRequested = true
-	to := timeout
+	to := make([]time.Duration, len(timeouts))
+	copy(to, timeouts)
 	srM.Unlock()
+	notifySystemdStopping()
+	waitForLocks()
+	mainCancel()
 	sqM.Lock()
 	defer sqM.Unlock()
 	for stage, queue := range shutdownQueue {
+		stageCancel[stage]()
+		if stage == StageFirst {
+			// Drainables run to completion before the first stage's
+			// notifiers are sent, sharing a single deadline set from
+			// the first stage's timeout budget, so worker pools and
+			// the like can finish in-flight work before being stopped
+			// for good and before first-stage notifiers see them go.
+			runDrainables(to[StageFirst])
+		}
+		stageCancel[stage]()
 		n := len(queue)
 		if n == 0 {
 			continue
 		}
-		log.Println("Shutdown stage", stage+1)
+		log.Println("Shutdown stage", stageName(stage))
 		wait := make([]chan struct{}, n)
 
 		// Send notification to all waiting
@@ -221,7 +308,7 @@ func Shutdown() {
 		}
 
 		// Wait for all to return, no more than the shutdown delay
-		timeout := time.After(to)
+		timeout := time.After(to[stage])
 		for i := range wait {
 			select {
 			case <-wait[i]:
@@ -232,8 +319,24 @@ func Shutdown() {
 		}
 	}
 	// Reset - mainly for tests.
-	shutdownQueue = [3][]Notifier{}
-	shutdownFnQueue = [3][]fnNotify{}
+	shutdownQueue = make([][]Notifier, StageCount)
+	shutdownFnQueue = make([][]fnNotify, StageCount)
+}
+
+// stageName returns a human readable name for a shutdown stage, for logging.
+func stageName(stage int) string {
+	switch stage {
+	case StagePreShutdown:
+		return "preshutdown"
+	case StageFirst:
+		return "first"
+	case StageSecond:
+		return "second"
+	case StageThird:
+		return "third"
+	default:
+		return "unknown"
+	}
 }
 
 // Started returns true if shutdown has been started.
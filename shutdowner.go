@@ -0,0 +1,111 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ShutdownOption is used to configure a programmatic shutdown request,
+// see Shutdown and Shutdowner.
+type ShutdownOption func(*shutdownOptions)
+
+type shutdownOptions struct {
+	exitCode    int
+	exitCodeSet bool
+}
+
+// ExitCode sets the exit code that should be reported through Wait for this
+// shutdown request. If Shutdown is called several times with different exit
+// codes, the latest explicitly set one wins; a plain Shutdown() with no
+// ExitCode option never resets a code set by an earlier call.
+func ExitCode(code int) ShutdownOption {
+	return func(o *shutdownOptions) {
+		o.exitCode = code
+		o.exitCodeSet = true
+	}
+}
+
+// Shutdowner can be implemented by anything that wants to trigger a
+// graceful shutdown of the application, e.g. a subsystem that has detected
+// it can no longer operate. GetShutdowner returns the package-level
+// implementation, so callers don't need to import shutdown directly.
+type Shutdowner interface {
+	Shutdown(opts ...ShutdownOption)
+}
+
+type pkgShutdowner struct{}
+
+func (pkgShutdowner) Shutdown(opts ...ShutdownOption) {
+	Shutdown(opts...)
+}
+
+// GetShutdowner returns a Shutdowner that requests the package-level
+// Shutdown when its Shutdown method is called.
+func GetShutdowner() Shutdowner {
+	return pkgShutdowner{}
+}
+
+// ShutdownSignal describes why a shutdown was triggered.
+type ShutdownSignal struct {
+	// Signal is the OS signal that triggered the shutdown,
+	// or nil if it was requested programmatically.
+	Signal os.Signal
+
+	// ExitCode is the code that should be passed to os.Exit.
+	ExitCode int
+}
+
+var (
+	shutdownRequestChannel = make(chan struct{})
+	shutdownRequestOnce    sync.Once
+
+	shutdownSignalM sync.Mutex
+	shutdownSignal  os.Signal
+
+	shutdownExitCode int32 // atomic
+)
+
+// requestShutdown records why a shutdown was requested and wakes up any
+// goroutine waiting in Wait. It can safely be called multiple times; the
+// first non-nil signal is kept, and the exit code is only updated when
+// hasExitCode is true, so a plain Shutdown() can't clobber a code an
+// earlier, more specific call set.
+func requestShutdown(sig os.Signal, exitCode int, hasExitCode bool) {
+	if hasExitCode {
+		atomic.StoreInt32(&shutdownExitCode, int32(exitCode))
+	}
+	shutdownSignalM.Lock()
+	if shutdownSignal == nil {
+		shutdownSignal = sig
+	}
+	shutdownSignalM.Unlock()
+	shutdownRequestOnce.Do(func() {
+		close(shutdownRequestChannel)
+	})
+}
+
+// Wait returns a channel that is sent a ShutdownSignal once a shutdown has
+// been requested, either by an OS signal registered through OnSignal or by
+// a programmatic call to Shutdown/Shutdowner.Shutdown. This lets main defer
+// its own cleanup and pick an exit code depending on why shutdown happened,
+// instead of OnSignal calling os.Exit on its own.
+//
+// Wait can be called any number of times; every caller receives the signal
+// once it has occurred.
+func Wait() <-chan ShutdownSignal {
+	out := make(chan ShutdownSignal, 1)
+	go func() {
+		<-shutdownRequestChannel
+		shutdownSignalM.Lock()
+		sig := shutdownSignal
+		shutdownSignalM.Unlock()
+		out <- ShutdownSignal{
+			Signal:   sig,
+			ExitCode: int(atomic.LoadInt32(&shutdownExitCode)),
+		}
+	}()
+	return out
+}
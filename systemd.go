@@ -0,0 +1,89 @@
+// Copyright (c) 2015 Klaus Post, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	sdNotifyReady     = "READY=1"
+	sdNotifyStopping  = "STOPPING=1"
+	sdNotifyWatchdog  = "WATCHDOG=1"
+	sdNotifySocketEnv = "NOTIFY_SOCKET"
+	sdWatchdogUsecEnv = "WATCHDOG_USEC"
+)
+
+var systemdM sync.Mutex // Mutex for below
+var systemdEnabled bool
+
+// EnableSystemdNotify enables integration with systemd's sd_notify protocol,
+// for processes running as a Type=notify unit. It sends READY=1 right away,
+// STOPPING=1 as soon as Shutdown is called, and if WATCHDOG_USEC is set in
+// the environment, starts pinging WATCHDOG=1 at half that interval until
+// shutdown begins.
+//
+// It is a no-op, returning nil, if NOTIFY_SOCKET is not set, which is the
+// case unless the process was started by systemd.
+func EnableSystemdNotify() error {
+	systemdM.Lock()
+	systemdEnabled = true
+	systemdM.Unlock()
+
+	if err := sdNotify(sdNotifyReady); err != nil {
+		return err
+	}
+
+	if usec := os.Getenv(sdWatchdogUsecEnv); usec != "" {
+		if n, err := strconv.ParseInt(usec, 10, 64); err == nil && n > 0 {
+			go systemdWatchdog(time.Duration(n) * time.Microsecond / 2)
+		}
+	}
+	return nil
+}
+
+// systemdWatchdog pings the systemd watchdog at the given interval until
+// shutdown begins.
+func systemdWatchdog(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			sdNotify(sdNotifyWatchdog)
+		case <-Context().Done():
+			return
+		}
+	}
+}
+
+// notifySystemdStopping tells systemd the service is shutting down, if
+// EnableSystemdNotify was called.
+func notifySystemdStopping() {
+	systemdM.Lock()
+	enabled := systemdEnabled
+	systemdM.Unlock()
+	if enabled {
+		sdNotify(sdNotifyStopping)
+	}
+}
+
+// sdNotify sends a newline-separated KEY=value state to the unix datagram
+// socket named by NOTIFY_SOCKET, per the sd_notify(3) protocol.
+func sdNotify(state string) error {
+	socket := os.Getenv(sdNotifySocketEnv)
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}